@@ -2,6 +2,7 @@ package db
 
 import (
 	"fmt"
+	"github.com/mongodb/mongo-tools/common/log"
 	"gopkg.in/mgo.v2/bson"
 	"io"
 )
@@ -12,13 +13,27 @@ type BSONSource struct {
 	reusableBuf []byte
 	Stream      io.ReadCloser
 	err         error
+
+	// MaxDocumentSize is the largest document size, in bytes, that LoadNext
+	// will accept. If zero or negative, MaxBSONSize is used.
+	MaxDocumentSize int
 }
 
 // DecodedBSONSource reads documents from the underlying io.ReadCloser, Stream which
 // wraps a stream of BSON documents.
 type DecodedBSONSource struct {
 	RawDocSource
-	err error
+	err     error
+	count   int
+	skipped int
+
+	// SkipMalformed causes Next to log and skip documents that cannot be
+	// unmarshaled instead of stopping. Documents with an invalid size prefix
+	// still end iteration, since the stream cannot be resynchronized.
+	SkipMalformed bool
+
+	// peeked holds a copy of the document read ahead by Peek, if any
+	peeked []byte
 }
 
 // RawDocSource wraps basic functions for reading a BSON source file.
@@ -30,12 +45,12 @@ type RawDocSource interface {
 
 // NewBSONSource creates a BSONSource with a reusable I/O buffer
 func NewBSONSource(in io.ReadCloser) *BSONSource {
-	return &BSONSource{make([]byte, MaxBSONSize), in, nil}
+	return &BSONSource{reusableBuf: make([]byte, MaxBSONSize), Stream: in}
 }
 
 // NewBufferlessBSONSource creates a BSONSource without a reusable I/O buffer
 func NewBufferlessBSONSource(in io.ReadCloser) *BSONSource {
-	return &BSONSource{nil, in, nil}
+	return &BSONSource{Stream: in}
 }
 
 // Close closes the BSONSource, rendering it unusable for I/O.
@@ -45,7 +60,7 @@ func (bs *BSONSource) Close() error {
 }
 
 func NewDecodedBSONSource(ds RawDocSource) *DecodedBSONSource {
-	return &DecodedBSONSource{ds, nil}
+	return &DecodedBSONSource{RawDocSource: ds}
 }
 
 // Err returns any error in the DecodedBSONSource or its RawDocSource.
@@ -57,25 +72,124 @@ func (dbs *DecodedBSONSource) Err() error {
 }
 
 // Next unmarshals the next BSON document into result. Returns true if no errors
-// are encountered and false otherwise.
+// are encountered and false otherwise. If SkipMalformed is set, documents that
+// fail to unmarshal are skipped rather than treated as errors.
 func (dbs *DecodedBSONSource) Next(result interface{}) bool {
+	for {
+		doc := dbs.LoadNext()
+		if doc == nil {
+			return false
+		}
+		if err := bson.Unmarshal(doc, result); err != nil {
+			if dbs.SkipMalformed {
+				dbs.skipped++
+				log.Logf(log.Always, "skipping malformed BSON document: %v", err)
+				continue
+			}
+			dbs.err = err
+			return false
+		}
+		dbs.err = nil
+		dbs.count++
+		return true
+	}
+}
+
+// Skipped returns the number of malformed documents skipped by Next when
+// SkipMalformed is set.
+func (dbs *DecodedBSONSource) Skipped() int {
+	return dbs.skipped
+}
+
+// Peek unmarshals the next BSON document into out without consuming it, so the
+// following call to Next or NextRaw returns the same document. Returns false
+// and a nil error at the end of the stream. If SkipMalformed is set, documents
+// that fail to unmarshal are skipped, as they are by Next.
+func (dbs *DecodedBSONSource) Peek(out interface{}) (bool, error) {
+	for {
+		if dbs.peeked == nil {
+			doc := dbs.RawDocSource.LoadNext()
+			if doc == nil {
+				return false, dbs.Err()
+			}
+			// copy the document, since the RawDocSource may reuse its buffer
+			// on the next read
+			dbs.peeked = make([]byte, len(doc))
+			copy(dbs.peeked, doc)
+		}
+		if err := bson.Unmarshal(dbs.peeked, out); err != nil {
+			if dbs.SkipMalformed {
+				dbs.skipped++
+				dbs.peeked = nil
+				log.Logf(log.Always, "skipping malformed BSON document: %v", err)
+				continue
+			}
+			return false, err
+		}
+		return true, nil
+	}
+}
+
+// LoadNext returns the document buffered by Peek, if there is one, and
+// otherwise reads the next document from the RawDocSource.
+func (dbs *DecodedBSONSource) LoadNext() []byte {
+	if dbs.peeked != nil {
+		doc := dbs.peeked
+		dbs.peeked = nil
+		return doc
+	}
+	return dbs.RawDocSource.LoadNext()
+}
+
+// Count returns the number of documents successfully returned by Next or
+// NextRaw so far.
+func (dbs *DecodedBSONSource) Count() int {
+	return dbs.count
+}
+
+// NextRaw returns the next BSON document without unmarshaling it, along with
+// true if a document was read. The returned bson.Raw holds a copy of the
+// document bytes, so it remains valid after subsequent reads from the source.
+// Returns false at the end of the stream or on error; check Err to
+// distinguish the two.
+func (dbs *DecodedBSONSource) NextRaw() (bson.Raw, bool) {
 	doc := dbs.LoadNext()
 	if doc == nil {
-		return false
-	}
-	if err := bson.Unmarshal(doc, result); err != nil {
-		dbs.err = err
-		return false
+		return bson.Raw{}, false
 	}
+	data := make([]byte, len(doc))
+	copy(data, doc)
 	dbs.err = nil
-	return true
+	dbs.count++
+	return bson.Raw{Kind: 0x03, Data: data}, true
+}
+
+// NextBatch unmarshals up to n documents into out, replacing its previous
+// contents, and returns the number of documents read. Reaching the end of the
+// stream partway through a batch is not an error; the partial count is
+// returned with a nil error, and a count of zero indicates the stream is done.
+// An error is returned if n is not positive.
+func (dbs *DecodedBSONSource) NextBatch(n int, out *[]bson.D) (int, error) {
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid batch size: %v", n)
+	}
+	*out = (*out)[:0]
+	for len(*out) < n {
+		doc := bson.D{}
+		if !dbs.Next(&doc) {
+			return len(*out), dbs.Err()
+		}
+		*out = append(*out, doc)
+	}
+	return len(*out), nil
 }
 
 // LoadNext reads and returns the next BSON document in the stream. If the
 // BSONSource was created with NewBSONSource then each returned []byte will be
-// a slice of a single reused I/O buffer. If the BSONSource was created with
-// NewBufferlessBSONSource then each returend []byte will be individually
-// allocated
+// a slice of a single reused I/O buffer, and is only valid until the next call
+// to LoadNext; callers that need to keep a document must copy it. If the
+// BSONSource was created with NewBufferlessBSONSource then each returned
+// []byte will be individually allocated and may be retained.
 func (bs *BSONSource) LoadNext() []byte {
 	var into []byte
 	if bs.reusableBuf == nil {
@@ -86,6 +200,11 @@ func (bs *BSONSource) LoadNext() []byte {
 	// read the bson object size (a 4 byte integer)
 	_, err := io.ReadAtLeast(bs.Stream, into[0:4], 4)
 	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			// the stream ended partway through the size of a document
+			bs.err = fmt.Errorf("invalid bson: unexpected EOF in BSON document size")
+			return nil
+		}
 		if err != io.EOF {
 			bs.err = err
 			return nil
@@ -102,12 +221,22 @@ func (bs *BSONSource) LoadNext() []byte {
 			(uint32(into[3]) << 24),
 	)
 
-	// Verify that the size of the BSON object we are about to read can
-	// actually fit into the buffer that was provided. If not, either the BSON is
-	// invalid, or the buffer passed in is too small.
+	// Verify that the declared size of the BSON object we are about to read
+	// is within the maximum document size, so that a corrupt or foreign size
+	// prefix is reported rather than read into the buffer.
+	maxSize := bs.MaxDocumentSize
+	if maxSize <= 0 {
+		maxSize = MaxBSONSize
+	}
+	if int(bsonSize) > maxSize {
+		bs.err = fmt.Errorf("invalid BSONSize: %v bytes exceeds the maximum of %v bytes",
+			bsonSize, maxSize)
+		return nil
+	}
 	// Verify that we do not have an invalid BSON document with size < 5.
-	if bsonSize > MaxBSONSize || bsonSize < 5 {
-		bs.err = fmt.Errorf("invalid BSONSize: %v bytes", bsonSize)
+	if bsonSize < 5 {
+		bs.err = fmt.Errorf("invalid BSONSize: %v bytes is less than the minimum of 5 bytes",
+			bsonSize)
 		return nil
 	}
 	if int(bsonSize) > cap(into) {
@@ -119,15 +248,16 @@ func (bs *BSONSource) LoadNext() []byte {
 		}
 	}
 	into = into[:int(bsonSize)]
-	_, err = io.ReadAtLeast(bs.Stream, into[4:], int(bsonSize-4))
+	n, err := io.ReadAtLeast(bs.Stream, into[4:], int(bsonSize-4))
 	if err != nil {
-		if err != io.EOF {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
 			bs.err = err
 			return nil
 		}
 		// this case means we hit EOF but read a partial document,
 		// so there's a broken doc in the stream. Treat this as error.
-		bs.err = fmt.Errorf("invalid bson: %v", err)
+		bs.err = fmt.Errorf("invalid bson: unexpected EOF in BSON document "+
+			"(read %v of %v bytes)", n+4, bsonSize)
 		return nil
 	}
 
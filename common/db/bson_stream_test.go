@@ -2,9 +2,13 @@ package db
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
 	"gopkg.in/mgo.v2/bson"
+	"io"
 	"io/ioutil"
+	"strings"
 	"testing"
 )
 
@@ -39,3 +43,401 @@ func TestBufferlessBSONSource(t *testing.T) {
 		})
 	})
 }
+
+func TestDecodedBSONSourceCount(t *testing.T) {
+	Convey("with a buffer containing six bson documents", t, func() {
+		writeBuf := bytes.NewBuffer(make([]byte, 0, 1024))
+		for i := 0; i < 6; i++ {
+			data, err := bson.Marshal(bson.M{"n": i})
+			So(err, ShouldBeNil)
+			_, err = writeBuf.Write(data)
+			So(err, ShouldBeNil)
+		}
+		bsonSource := NewDecodedBSONSource(NewBSONSource(ioutil.NopCloser(writeBuf)))
+
+		Convey("Count should include documents from Next, NextRaw and NextBatch", func() {
+			So(bsonSource.Count(), ShouldEqual, 0)
+
+			doc := bson.M{}
+			So(bsonSource.Next(&doc), ShouldBeTrue)
+			So(bsonSource.Count(), ShouldEqual, 1)
+
+			_, ok := bsonSource.NextRaw()
+			So(ok, ShouldBeTrue)
+			So(bsonSource.Count(), ShouldEqual, 2)
+
+			batch := []bson.D{}
+			n, err := bsonSource.NextBatch(10, &batch)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 4)
+			So(bsonSource.Count(), ShouldEqual, 6)
+
+			So(bsonSource.Next(&doc), ShouldBeFalse)
+			So(bsonSource.Count(), ShouldEqual, 6)
+		})
+	})
+}
+
+func TestDecodedBSONSourceNextRaw(t *testing.T) {
+	Convey("with a buffer containing several bson documents", t, func() {
+		writeBuf := bytes.NewBuffer(make([]byte, 0, 1024))
+		expected := [][]byte{}
+		for _, fruit := range []string{"apples", "bananas", "cherries"} {
+			data, err := bson.Marshal(bson.M{"fruit": fruit})
+			So(err, ShouldBeNil)
+			expected = append(expected, data)
+			_, err = writeBuf.Write(data)
+			So(err, ShouldBeNil)
+		}
+
+		Convey("NextRaw should return copies that survive buffer reuse", func() {
+			bsonSource := NewDecodedBSONSource(NewBSONSource(ioutil.NopCloser(writeBuf)))
+			raws := []bson.Raw{}
+			for {
+				raw, ok := bsonSource.NextRaw()
+				if !ok {
+					break
+				}
+				raws = append(raws, raw)
+			}
+			So(bsonSource.Err(), ShouldBeNil)
+			So(bsonSource.Count(), ShouldEqual, len(expected))
+			So(len(raws), ShouldEqual, len(expected))
+			for i, raw := range raws {
+				So(raw.Data, ShouldResemble, expected[i])
+				doc := bson.M{}
+				So(raw.Unmarshal(&doc), ShouldBeNil)
+				So(doc["fruit"], ShouldNotBeNil)
+			}
+		})
+	})
+}
+
+func TestDecodedBSONSourceSkipMalformed(t *testing.T) {
+	Convey("with a buffer containing a corrupt document between valid ones", t, func() {
+		writeBuf := bytes.NewBuffer(make([]byte, 0, 1024))
+		for i := 0; i < 3; i++ {
+			data, err := bson.Marshal(bson.M{"n": i})
+			So(err, ShouldBeNil)
+			if i == 1 {
+				// replace the element type with one that does not exist
+				data[4] = 0x99
+			}
+			_, err = writeBuf.Write(data)
+			So(err, ShouldBeNil)
+		}
+		bsonSource := NewDecodedBSONSource(NewBSONSource(ioutil.NopCloser(writeBuf)))
+
+		Convey("Next should stop at the corrupt document by default", func() {
+			doc := bson.M{}
+			So(bsonSource.Next(&doc), ShouldBeTrue)
+			So(bsonSource.Next(&doc), ShouldBeFalse)
+			So(bsonSource.Err(), ShouldNotBeNil)
+			So(bsonSource.Skipped(), ShouldEqual, 0)
+		})
+
+		Convey("Next should skip the corrupt document with SkipMalformed", func() {
+			bsonSource.SkipMalformed = true
+			docs := []bson.M{}
+			doc := bson.M{}
+			for bsonSource.Next(&doc) {
+				docs = append(docs, doc)
+				doc = bson.M{}
+			}
+			So(bsonSource.Err(), ShouldBeNil)
+			So(docs, ShouldResemble, []bson.M{{"n": 0}, {"n": 2}})
+			So(bsonSource.Count(), ShouldEqual, 2)
+			So(bsonSource.Skipped(), ShouldEqual, 1)
+		})
+
+		Convey("Peek should also skip the corrupt document with SkipMalformed", func() {
+			bsonSource.SkipMalformed = true
+			doc := bson.M{}
+			So(bsonSource.Next(&doc), ShouldBeTrue)
+			So(doc["n"], ShouldEqual, 0)
+
+			peeked := bson.M{}
+			ok, err := bsonSource.Peek(&peeked)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(peeked["n"], ShouldEqual, 2)
+			So(bsonSource.Skipped(), ShouldEqual, 1)
+
+			doc = bson.M{}
+			So(bsonSource.Next(&doc), ShouldBeTrue)
+			So(doc, ShouldResemble, peeked)
+			So(bsonSource.Next(&doc), ShouldBeFalse)
+			So(bsonSource.Err(), ShouldBeNil)
+			So(bsonSource.Skipped(), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestDecodedBSONSourcePeek(t *testing.T) {
+	Convey("with a buffer containing two bson documents", t, func() {
+		writeBuf := bytes.NewBuffer(make([]byte, 0, 1024))
+		for i := 0; i < 2; i++ {
+			data, err := bson.Marshal(bson.M{"n": i})
+			So(err, ShouldBeNil)
+			_, err = writeBuf.Write(data)
+			So(err, ShouldBeNil)
+		}
+		bsonSource := NewDecodedBSONSource(NewBSONSource(ioutil.NopCloser(writeBuf)))
+
+		Convey("Peek should not consume the document returned by LoadNext", func() {
+			peeked := bson.M{}
+			ok, err := bsonSource.Peek(&peeked)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(peeked["n"], ShouldEqual, 0)
+
+			loaded := bson.M{}
+			So(bson.Unmarshal(bsonSource.LoadNext(), &loaded), ShouldBeNil)
+			So(loaded, ShouldResemble, peeked)
+
+			So(bson.Unmarshal(bsonSource.LoadNext(), &loaded), ShouldBeNil)
+			So(loaded["n"], ShouldEqual, 1)
+			So(bsonSource.LoadNext(), ShouldBeNil)
+		})
+
+		Convey("Peek should not consume the document returned by Next", func() {
+			peeked := bson.M{}
+			ok, err := bsonSource.Peek(&peeked)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(peeked["n"], ShouldEqual, 0)
+
+			peekedAgain := bson.M{}
+			ok, err = bsonSource.Peek(&peekedAgain)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(peekedAgain, ShouldResemble, peeked)
+
+			next := bson.M{}
+			So(bsonSource.Next(&next), ShouldBeTrue)
+			So(next, ShouldResemble, peeked)
+
+			So(bsonSource.Next(&next), ShouldBeTrue)
+			So(next["n"], ShouldEqual, 1)
+			So(bsonSource.Count(), ShouldEqual, 2)
+
+			Convey("and Peek at the end of the stream should return false", func() {
+				ok, err := bsonSource.Peek(&peeked)
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeFalse)
+				So(bsonSource.Next(&next), ShouldBeFalse)
+				So(bsonSource.Err(), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestDecodedBSONSourceNextBatch(t *testing.T) {
+	Convey("with a buffer containing five bson documents", t, func() {
+		writeBuf := bytes.NewBuffer(make([]byte, 0, 1024))
+		for i := 0; i < 5; i++ {
+			data, err := bson.Marshal(bson.D{{"n", i}})
+			So(err, ShouldBeNil)
+			_, err = writeBuf.Write(data)
+			So(err, ShouldBeNil)
+		}
+		bsonSource := NewDecodedBSONSource(NewBSONSource(ioutil.NopCloser(writeBuf)))
+		batch := []bson.D{}
+
+		Convey("full batches should be followed by a partial batch and then an empty one", func() {
+			n, err := bsonSource.NextBatch(2, &batch)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+			So(batch, ShouldResemble, []bson.D{{{"n", 0}}, {{"n", 1}}})
+
+			n, err = bsonSource.NextBatch(2, &batch)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+			So(batch, ShouldResemble, []bson.D{{{"n", 2}}, {{"n", 3}}})
+
+			n, err = bsonSource.NextBatch(2, &batch)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			So(batch, ShouldResemble, []bson.D{{{"n", 4}}})
+
+			n, err = bsonSource.NextBatch(2, &batch)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 0)
+			So(batch, ShouldBeEmpty)
+		})
+
+		Convey("a non-positive batch size should be an error and read nothing", func() {
+			n, err := bsonSource.NextBatch(0, &batch)
+			So(err, ShouldNotBeNil)
+			So(n, ShouldEqual, 0)
+			n, err = bsonSource.NextBatch(-1, &batch)
+			So(err, ShouldNotBeNil)
+			So(n, ShouldEqual, 0)
+
+			n, err = bsonSource.NextBatch(5, &batch)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 5)
+		})
+
+		Convey("a truncated stream should return the documents read and the error", func() {
+			writeBuf.Truncate(writeBuf.Len() - 1)
+			n, err := bsonSource.NextBatch(10, &batch)
+			So(err, ShouldNotBeNil)
+			So(n, ShouldEqual, 4)
+			So(bsonSource.Count(), ShouldEqual, 4)
+		})
+	})
+}
+
+func TestBSONSourceSizeValidation(t *testing.T) {
+	Convey("with a stream whose size prefix is larger than MaxBSONSize", t, func() {
+		sizeBuf := make([]byte, 4)
+		binary.LittleEndian.PutUint32(sizeBuf, uint32(MaxBSONSize+1))
+		stream := append(sizeBuf, bytes.Repeat([]byte{0}, 16)...)
+
+		Convey("LoadNext should fail with the declared size and the limit", func() {
+			bsonSource := NewBSONSource(ioutil.NopCloser(bytes.NewReader(stream)))
+			So(bsonSource.LoadNext(), ShouldBeNil)
+			So(bsonSource.Err(), ShouldNotBeNil)
+			So(bsonSource.Err().Error(), ShouldContainSubstring, fmt.Sprint(MaxBSONSize+1))
+			So(bsonSource.Err().Error(), ShouldContainSubstring, fmt.Sprint(MaxBSONSize))
+		})
+	})
+
+	Convey("with a BSONSource with a custom MaxDocumentSize", t, func() {
+		doc, err := bson.Marshal(bson.M{"payload": strings.Repeat("x", 100)})
+		So(err, ShouldBeNil)
+
+		Convey("a document just under the limit should be accepted", func() {
+			bsonSource := NewBufferlessBSONSource(ioutil.NopCloser(bytes.NewReader(doc)))
+			bsonSource.MaxDocumentSize = len(doc) + 1
+			So(bsonSource.LoadNext(), ShouldResemble, doc)
+			So(bsonSource.Err(), ShouldBeNil)
+		})
+
+		Convey("a negative limit should fall back to MaxBSONSize", func() {
+			bsonSource := NewBufferlessBSONSource(ioutil.NopCloser(bytes.NewReader(doc)))
+			bsonSource.MaxDocumentSize = -1
+			So(bsonSource.LoadNext(), ShouldResemble, doc)
+			So(bsonSource.Err(), ShouldBeNil)
+		})
+
+		Convey("a document just over the limit should be rejected", func() {
+			bsonSource := NewBufferlessBSONSource(ioutil.NopCloser(bytes.NewReader(doc)))
+			bsonSource.MaxDocumentSize = len(doc) - 1
+			So(bsonSource.LoadNext(), ShouldBeNil)
+			So(bsonSource.Err(), ShouldNotBeNil)
+			So(bsonSource.Err().Error(), ShouldContainSubstring, fmt.Sprint(len(doc)-1))
+		})
+	})
+
+	Convey("with a stream whose size prefix is smaller than an empty document", t, func() {
+		stream := []byte{4, 0, 0, 0}
+
+		Convey("LoadNext should fail", func() {
+			bsonSource := NewBufferlessBSONSource(ioutil.NopCloser(bytes.NewReader(stream)))
+			So(bsonSource.LoadNext(), ShouldBeNil)
+			So(bsonSource.Err(), ShouldNotBeNil)
+			So(bsonSource.Err().Error(), ShouldContainSubstring, "minimum")
+		})
+	})
+}
+
+func TestBSONSourceTruncatedStream(t *testing.T) {
+	Convey("with a valid bson document", t, func() {
+		doc, err := bson.Marshal(bson.M{"fruit": "apples"})
+		So(err, ShouldBeNil)
+
+		Convey("a stream ending at a document boundary should end cleanly", func() {
+			bsonSource := NewBSONSource(ioutil.NopCloser(bytes.NewReader(doc)))
+			So(bsonSource.LoadNext(), ShouldResemble, doc)
+			So(bsonSource.LoadNext(), ShouldBeNil)
+			So(bsonSource.Err(), ShouldBeNil)
+		})
+
+		Convey("a stream ending partway through a document should fail", func() {
+			truncated := append(append([]byte{}, doc...), doc[:len(doc)-3]...)
+			bsonSource := NewBSONSource(ioutil.NopCloser(bytes.NewReader(truncated)))
+			So(bsonSource.LoadNext(), ShouldResemble, doc)
+			So(bsonSource.LoadNext(), ShouldBeNil)
+			So(bsonSource.Err(), ShouldNotBeNil)
+			So(bsonSource.Err().Error(), ShouldContainSubstring, "unexpected EOF in BSON document")
+			So(bsonSource.Err().Error(), ShouldContainSubstring,
+				fmt.Sprintf("read %v of %v bytes", len(doc)-3, len(doc)))
+		})
+
+		Convey("a stream ending right after a document size should fail", func() {
+			bsonSource := NewBSONSource(ioutil.NopCloser(bytes.NewReader(doc[:4])))
+			So(bsonSource.LoadNext(), ShouldBeNil)
+			So(bsonSource.Err(), ShouldNotBeNil)
+			So(bsonSource.Err().Error(), ShouldContainSubstring, "unexpected EOF in BSON document")
+		})
+
+		Convey("a stream ending partway through a document size should fail", func() {
+			bsonSource := NewBSONSource(ioutil.NopCloser(bytes.NewReader(doc[:2])))
+			So(bsonSource.LoadNext(), ShouldBeNil)
+			So(bsonSource.Err(), ShouldNotBeNil)
+			So(bsonSource.Err().Error(), ShouldContainSubstring, "unexpected EOF in BSON document size")
+		})
+	})
+}
+
+// benchmarkLoadNext measures LoadNext over a stream of b.N identical 1KB
+// documents read through the BSONSource returned by newSource.
+func benchmarkLoadNext(b *testing.B, newSource func(io.ReadCloser) *BSONSource) {
+	doc, err := bson.Marshal(bson.M{"payload": strings.Repeat("x", 1024)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	bsonSource := newSource(ioutil.NopCloser(bytes.NewReader(bytes.Repeat(doc, b.N))))
+	b.SetBytes(int64(len(doc)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for bsonSource.LoadNext() != nil {
+	}
+	if err := bsonSource.Err(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkLoadNextReusableBuffer(b *testing.B) {
+	benchmarkLoadNext(b, NewBSONSource)
+}
+
+func BenchmarkLoadNextBufferless(b *testing.B) {
+	benchmarkLoadNext(b, NewBufferlessBSONSource)
+}
+
+// benchmarkDecode measures decoding a stream of b.N identical 1KB documents
+// with the given read function.
+func benchmarkDecode(b *testing.B, read func(*DecodedBSONSource) bool) {
+	doc, err := bson.Marshal(bson.M{"payload": strings.Repeat("x", 1024)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	bsonSource := NewDecodedBSONSource(
+		NewBSONSource(ioutil.NopCloser(bytes.NewReader(bytes.Repeat(doc, b.N)))))
+	b.SetBytes(int64(len(doc)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for read(bsonSource) {
+	}
+	if err := bsonSource.Err(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkDecodeNext(b *testing.B) {
+	benchmarkDecode(b, func(bsonSource *DecodedBSONSource) bool {
+		doc := bson.D{}
+		return bsonSource.Next(&doc)
+	})
+}
+
+func BenchmarkDecodeNextBatch(b *testing.B) {
+	batch := make([]bson.D, 0, 100)
+	benchmarkDecode(b, func(bsonSource *DecodedBSONSource) bool {
+		n, _ := bsonSource.NextBatch(100, &batch)
+		return n > 0
+	})
+}